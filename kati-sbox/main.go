@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	outDir  = flag.String("out-dir", "", "private directory the recipe runs in")
+	outputs = flag.String("outputs", "", "space-separated list of declared output paths")
+)
+
+func main() {
+	flag.Parse()
+	// flag.Parse already consumes the "--" terminator, so flag.Args()
+	// starts directly at the command to run.
+	args := flag.Args()
+	if *outDir == "" || *outputs == "" || len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: kati-sbox --out-dir DIR --outputs \"OUT...\" -- CMD...")
+		os.Exit(2)
+	}
+
+	if err := run(*outDir, strings.Fields(*outputs), args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
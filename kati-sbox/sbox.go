@@ -0,0 +1,122 @@
+// Command kati-sbox runs a single ninja rule's recipe inside a private
+// temporary directory, then verifies that every output the rule declared
+// was actually produced before moving it into place. This catches
+// underspecified Make recipes that silently depend on sibling
+// intermediates left behind by an earlier build, a recurring source of
+// incremental-build bugs in Android's kati->ninja pipeline.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// run executes argv (e.g. ["sh", "-c", "<script>"]) inside a fresh
+// directory at outDir, rewriting every whole-path occurrence of an output
+// path in argv (see replacePathToken) to a path inside outDir so the
+// recipe writes there instead of directly to the real output locations.
+// Once argv exits successfully, run verifies that every output was
+// produced and moves it to its real location, then removes outDir along
+// with anything else the recipe left in it. Files the recipe wrote
+// outside outDir are left in place.
+func run(outDir string, outputs []string, argv []string) error {
+	if err := os.RemoveAll(outDir); err != nil {
+		return fmt.Errorf("kati-sbox: cannot clear %s: %v", outDir, err)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("kati-sbox: cannot create %s: %v", outDir, err)
+	}
+	defer os.RemoveAll(outDir)
+
+	sandboxed := make(map[string]string, len(outputs))
+	sandboxedArgv := make([]string, len(argv))
+	copy(sandboxedArgv, argv)
+	for _, output := range outputs {
+		sp := filepath.Join(outDir, filepath.Base(output))
+		sandboxed[output] = sp
+		for i, a := range sandboxedArgv {
+			sandboxedArgv[i] = replacePathToken(a, output, sp)
+		}
+	}
+
+	c := exec.Command(sandboxedArgv[0], sandboxedArgv[1:]...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("kati-sbox: command failed: %v", err)
+	}
+
+	var missing []string
+	for _, output := range outputs {
+		if _, err := os.Stat(sandboxed[output]); err != nil {
+			missing = append(missing, output)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kati-sbox: command did not produce declared output(s): %s", strings.Join(missing, ", "))
+	}
+
+	for _, output := range outputs {
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return fmt.Errorf("kati-sbox: cannot create directory for %s: %v", output, err)
+		}
+		if err := os.Rename(sandboxed[output], output); err != nil {
+			return fmt.Errorf("kati-sbox: cannot install %s: %v", output, err)
+		}
+	}
+	return nil
+}
+
+// isPathTokenChar reports whether c can appear inside a path or filename,
+// i.e. whether it extends a run of path characters rather than bounding
+// one. It's used by replacePathToken to tell a whole-path match (the
+// output path is the entire token) from a partial one (the output path
+// is merely a prefix or substring of a longer path, e.g. "foo.o" inside
+// sibling depfile "foo.o.d").
+func isPathTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '.' || c == '_' || c == '-' || c == '/' || c == '+':
+		return true
+	}
+	return false
+}
+
+// replacePathToken replaces every whole-path occurrence of old in s with
+// new. Unlike strings.Replace, a match is only accepted when it isn't
+// immediately preceded or followed by another path character, so an
+// output path that's a prefix of a sibling path (the classic case is an
+// object file output "foo.o" next to a compiler-written depfile
+// "foo.o.d") is left untouched instead of being corrupted into the
+// sandbox directory along with the genuine output.
+func replacePathToken(s, old, new string) string {
+	if old == "" {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(old)
+		boundedBefore := i == 0 || !isPathTokenChar(s[i-1])
+		boundedAfter := end == len(s) || !isPathTokenChar(s[end])
+		if boundedBefore && boundedAfter {
+			b.WriteString(s[:i])
+			b.WriteString(new)
+			s = s[end:]
+			continue
+		}
+		// Not a whole-path match: keep the first byte of this
+		// occurrence as-is and keep scanning from the next one, so we
+		// don't re-match the same non-boundary substring forever.
+		b.WriteString(s[:i+1])
+		s = s[i+1:]
+	}
+}
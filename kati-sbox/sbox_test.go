@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunProducesDeclaredOutput(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.txt")
+	sandbox := filepath.Join(dir, "out.txt.sbox")
+
+	argv := []string{"sh", "-c", "echo hello > " + out}
+	if err := run(sandbox, []string{out}, argv); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("output was not installed: %v", err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("output = %q, want %q", got, "hello\n")
+	}
+	if _, err := os.Stat(sandbox); !os.IsNotExist(err) {
+		t.Errorf("sandbox dir %s was not cleaned up", sandbox)
+	}
+}
+
+// TestRunMultiWordRecipe exercises the exact argv shape ninja.go builds
+// ("sh" "-c" "<script>"): a regression test for run() re-joining argv
+// into a single string and re-parsing it through an extra "sh -c", which
+// silently truncated every recipe to its first word.
+func TestRunMultiWordRecipe(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.txt")
+	sandbox := filepath.Join(dir, "out.txt.sbox")
+
+	argv := []string{"sh", "-c", "echo hello world > " + out}
+	if err := run(sandbox, []string{out}, argv); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("output was not installed: %v", err)
+	}
+	if string(got) != "hello world\n" {
+		t.Errorf("output = %q, want %q", got, "hello world\n")
+	}
+}
+
+func TestRunMissingOutputFails(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.txt")
+	sandbox := filepath.Join(dir, "out.txt.sbox")
+
+	err := run(sandbox, []string{out}, []string{"sh", "-c", "true"})
+	if err == nil {
+		t.Fatal("run: expected an error for a missing declared output, got nil")
+	}
+	if _, statErr := os.Stat(out); !os.IsNotExist(statErr) {
+		t.Errorf("output %s should not exist", out)
+	}
+}
+
+// TestRunLeavesSiblingDepfileAlone is a regression test for a
+// substring-matching bug: a declared output like "foo.o" is also a
+// prefix of an undeclared sibling path like the "-MF" depfile
+// "foo.o.d" that a compile recipe writes alongside it. A naive
+// strings.Replace of the output path would rewrite the depfile's path
+// into the sandbox too, and since it's never in outputs it would never
+// get moved back out, silently vanishing with the sandbox dir. Only the
+// declared output's own path should be redirected.
+func TestRunLeavesSiblingDepfileAlone(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "foo.o")
+	depfile := out + ".d"
+	sandbox := out + ".sbox"
+
+	argv := []string{"sh", "-c", "echo obj > " + out + " && echo dep > " + depfile}
+	if err := run(sandbox, []string{out}, argv); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("output was not installed: %v", err)
+	}
+	if string(got) != "obj\n" {
+		t.Errorf("output = %q, want %q", got, "obj\n")
+	}
+
+	gotDep, err := os.ReadFile(depfile)
+	if err != nil {
+		t.Fatalf("sibling depfile was lost: %v", err)
+	}
+	if string(gotDep) != "dep\n" {
+		t.Errorf("depfile = %q, want %q", gotDep, "dep\n")
+	}
+}
+
+func TestRunCommandFailureIsReported(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.txt")
+	sandbox := filepath.Join(dir, "out.txt.sbox")
+
+	if err := run(sandbox, []string{out}, []string{"sh", "-c", "exit 1"}); err == nil {
+		t.Fatal("run: expected the recipe's failure to propagate")
+	}
+}
+
+func TestReplacePathToken(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "whole token replaced",
+			s:    "cc -o foo.o -c foo.c",
+			old:  "foo.o",
+			new:  "/tmp/sbox/foo.o",
+			want: "cc -o /tmp/sbox/foo.o -c foo.c",
+		},
+		{
+			name: "prefix of a longer sibling path is left alone",
+			s:    "cc -o foo.o -MF foo.o.d -c foo.c",
+			old:  "foo.o",
+			new:  "/tmp/sbox/foo.o",
+			want: "cc -o /tmp/sbox/foo.o -MF foo.o.d -c foo.c",
+		},
+		{
+			name: "suffix of a longer sibling path is left alone",
+			s:    "cc -o bar_foo.o -c foo.c",
+			old:  "foo.o",
+			new:  "/tmp/sbox/foo.o",
+			want: "cc -o bar_foo.o -c foo.c",
+		},
+		{
+			name: "repeated whole-token occurrences all replaced",
+			s:    "cp foo.o foo.o.bak.orig; mv foo.o.bak.orig foo.o",
+			old:  "foo.o",
+			new:  "/tmp/sbox/foo.o",
+			want: "cp /tmp/sbox/foo.o foo.o.bak.orig; mv foo.o.bak.orig /tmp/sbox/foo.o",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replacePathToken(tt.s, tt.old, tt.new); got != tt.want {
+				t.Errorf("replacePathToken(%q, %q, %q) = %q, want %q", tt.s, tt.old, tt.new, got, tt.want)
+			}
+		})
+	}
+}
@@ -7,9 +7,36 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 )
 
+// nodeState records what emitNode decided about a node's output the first
+// time it visited it.
+type nodeState int
+
+const (
+	// nodeInit is the zero value: the node has not been visited yet.
+	nodeInit nodeState = iota
+	// nodeVisit marks a node currently being classified, guarding against
+	// infinite recursion on a dependency cycle.
+	nodeVisit
+	// nodeFile is an output with no rule and no deps that already exists
+	// on disk, e.g. a source file. It is not emitted.
+	nodeFile
+	// nodeAlias is a non-phony output with no commands, exactly one
+	// non-order-only dep and no order-only deps; it is emitted as a ninja
+	// phony pointing at that single dep.
+	nodeAlias
+	// nodeMissing is an output with no rule, no deps, and no file on
+	// disk: it was referenced but nothing can build it.
+	nodeMissing
+	// nodeBuild is an output with commands (or an explicit phony target,
+	// or any other command-less output with deps that isn't an alias);
+	// it is emitted as a normal ninja `build` line.
+	nodeBuild
+)
+
 type NinjaGenerator struct {
 	f       *os.File
 	nodes   []*DepNode
@@ -17,24 +44,76 @@ type NinjaGenerator struct {
 	exports map[string]bool
 	ex      *Executor
 	ruleId  int
-	done    map[string]bool
 	ccRe    *regexp.Regexp
+
+	// state records, per output, what emitNode decided about it the
+	// first time it was visited, so a node reached through several
+	// dependency paths is only classified and emitted once.
+	state map[string]nodeState
+	// missingReferrers maps an output in state nodeMissing to every
+	// output that referenced it, so a diagnostic can name them all. A
+	// missing output reached only as a root has no entry.
+	missingReferrers map[string][]string
+
+	// ruleCache maps a rule's content (shell script + depfile + rspfile
+	// decision + description) to the rule name already emitted for it, so identical
+	// commands share a single `rule` block instead of getting their own
+	// ruleN on every node.
+	ruleCache map[string]string
+	// shortNames maps the basename of a build output to every full
+	// output path sharing that basename, used to emit `m <short>`-style
+	// phony aliases when ShortNames is enabled.
+	shortNames map[string][]string
+	// ShortNames, when set, emits a phony alias for the leaf basename
+	// of every build output, matching Android's `m <short>` workflow.
+	ShortNames bool
+
+	// Sandbox, when set, wraps every rule's command with kati-sbox so it
+	// runs in a private tmpdir and every declared $out is verified to
+	// have been produced. This catches underspecified Make recipes that
+	// silently depend on sibling intermediates.
+	Sandbox bool
+
+	// DetectAndroidEcho, when set, turns a leading `echo "..."` (or
+	// `@echo "..."`) runner into the rule's `description` instead of a
+	// command line, matching Android's echo-as-progress convention.
+	DetectAndroidEcho bool
+
+	// suffix is appended to the generated build.ninja/ninja.sh file
+	// names, so a single source tree can host several parallel ninja
+	// configurations (e.g. one per lunch target) without clobbering
+	// each other.
+	suffix string
 }
 
+// It seems Linux is OK with ~130kB.
+// TODO: Find this number automatically.
+const ArgLenLimit = 100 * 1000
+
 func NewNinjaGenerator(g *DepGraph) *NinjaGenerator {
 	ccRe, err := regexp.Compile(`^prebuilts/(gcc|clang)/.*(gcc|g\+\+|clang|clang\+\+) .* -c `)
 	if err != nil {
 		panic(err)
 	}
 	return &NinjaGenerator{
-		nodes:   g.nodes,
-		vars:    g.vars,
-		exports: g.exports,
-		done:    make(map[string]bool),
-		ccRe:    ccRe,
+		nodes:            g.nodes,
+		vars:             g.vars,
+		exports:          g.exports,
+		ccRe:             ccRe,
+		state:            make(map[string]nodeState),
+		missingReferrers: make(map[string][]string),
+		ruleCache:        make(map[string]string),
+		shortNames:       make(map[string][]string),
 	}
 }
 
+// fileExists reports whether path names a file already on disk, e.g. a
+// checked-in source file that has no rule of its own.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func getDepfileImpl(ss string) (string, error) {
 	tss := ss + " "
 	if !strings.Contains(tss, " -MD ") && !strings.Contains(tss, " -MMD ") {
@@ -127,6 +206,62 @@ func stripShellComment(s string) string {
 	return s
 }
 
+// detectAndroidEcho checks whether cmd is a bare `echo "..."` (optionally
+// prefixed with Make's `@` silencer) with nothing following the closing
+// quote, and if so returns the echoed text for use as a ninja rule
+// `description`. It walks the argument with the same quote/escape state
+// machine as stripShellComment so embedded quotes and backslashes don't
+// confuse the scan. A command substitution (backtick or $() is rejected,
+// since the echoed text would then depend on the environment and can't be
+// used verbatim; a literal $, which by this point is a real shell
+// variable reference (Make has already folded any `$$` down to a single
+// `$`), is allowed through but the caller must escape it for ninja the
+// same way genShellScript escapes a command's $.
+func detectAndroidEcho(cmd string) (string, bool) {
+	cmd = trimLeftSpace(cmd)
+	cmd = strings.TrimPrefix(cmd, "@")
+	if !strings.HasPrefix(cmd, "echo ") {
+		return "", false
+	}
+	arg := trimLeftSpace(cmd[len("echo "):])
+	if arg == "" || arg[0] != '"' {
+		return "", false
+	}
+
+	var desc bytes.Buffer
+	var escape bool
+	closeIndex := -1
+	for i := 1; i < len(arg); i++ {
+		c := arg[i]
+		if escape {
+			desc.WriteByte(c)
+			escape = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escape = true
+		case '"':
+			closeIndex = i
+		default:
+			desc.WriteByte(c)
+		}
+		if closeIndex >= 0 {
+			break
+		}
+	}
+	if closeIndex < 0 || trimLeftSpace(arg[closeIndex+1:]) != "" {
+		// Unterminated quote, or something follows it: not a bare echo.
+		return "", false
+	}
+
+	text := desc.String()
+	if strings.Contains(text, "$(") || strings.Contains(text, "`") {
+		return "", false
+	}
+	return text, true
+}
+
 func (n *NinjaGenerator) genShellScript(runners []runner) (string, bool) {
 	useGomacc := false
 	var buf bytes.Buffer
@@ -171,6 +306,12 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (string, bool) {
 	return buf.String(), gomaDir != "" && !useGomacc
 }
 
+// shellQuote wraps s in single quotes, escaping any single quotes it
+// contains, so it can be passed as a single `sh -c` argument.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func (n *NinjaGenerator) genRuleName() string {
 	ruleName := fmt.Sprintf("rule%d", n.ruleId)
 	n.ruleId++
@@ -201,23 +342,78 @@ func getDepString(node *DepNode) string {
 	return dep
 }
 
-func (n *NinjaGenerator) emitNode(node *DepNode) {
-	if n.done[node.Output] {
-		return
+// emitNode classifies node, emits the ninja build/rule block it needs (if
+// any), then recurses into its deps. referrer is the output that led here,
+// used only to build the diagnostic for a nodeMissing node; pass "" for a
+// root node. It returns the state node ended up in.
+func (n *NinjaGenerator) emitNode(node *DepNode, referrer string) nodeState {
+	if st, visited := n.state[node.Output]; visited {
+		if st == nodeMissing && referrer != "" {
+			n.missingReferrers[node.Output] = append(n.missingReferrers[node.Output], referrer)
+		}
+		return st
 	}
-	n.done[node.Output] = true
+	n.state[node.Output] = nodeVisit
 
-	if len(node.Cmds) == 0 && len(node.Deps) == 0 && !node.IsPhony {
-		return
+	var realDeps, orderOnlyDeps []*DepNode
+	for _, d := range node.Deps {
+		if d.IsOrderOnly {
+			orderOnlyDeps = append(orderOnlyDeps, d)
+		} else {
+			realDeps = append(realDeps, d)
+		}
+	}
+
+	if len(node.Cmds) == 0 && !node.IsPhony {
+		switch {
+		case len(realDeps) == 1 && len(orderOnlyDeps) == 0:
+			n.state[node.Output] = nodeAlias
+			n.emitBuild(node.Output, "phony", " "+realDeps[0].Output)
+			n.recordShortName(node.Output)
+			n.emitNode(realDeps[0], node.Output)
+			return nodeAlias
+
+		case len(node.Deps) == 0:
+			if fileExists(node.Output) {
+				n.state[node.Output] = nodeFile
+				return nodeFile
+			}
+			n.state[node.Output] = nodeMissing
+			if referrer != "" {
+				n.missingReferrers[node.Output] = append(n.missingReferrers[node.Output], referrer)
+			}
+			return nodeMissing
+		}
 	}
 
+	n.state[node.Output] = nodeBuild
+	n.emitBuildNode(node)
+	for _, d := range node.Deps {
+		n.emitNode(d, node.Output)
+	}
+	return nodeBuild
+}
+
+// emitBuildNode writes the rule/build block for a node that wasn't
+// resolved to a nodeAlias, nodeFile, or nodeMissing by emitNode: it either
+// has commands, is explicitly phony, or has deps but no commands of its
+// own.
+func (n *NinjaGenerator) emitBuildNode(node *DepNode) {
 	runners, _ := n.ex.createRunners(node, true)
 	ruleName := "phony"
 	useLocalPool := false
 	if len(runners) > 0 {
-		ruleName = n.genRuleName()
-		fmt.Fprintf(n.f, "rule %s\n", ruleName)
-		fmt.Fprintf(n.f, " description = build $out\n")
+		description := "build $out"
+		if n.DetectAndroidEcho && len(runners) > 1 {
+			if desc, ok := detectAndroidEcho(runners[0].cmd); ok {
+				// Escape $ the same way genShellScript escapes a
+				// command's $, since desc can contain a real shell
+				// variable reference (e.g. "$SRC_DIR") that must not be
+				// read back as a ninja variable.
+				description = strings.Replace(desc, "$", "$$", -1)
+				runners = runners[1:]
+			}
+		}
 
 		ss, ulp := n.genShellScript(runners)
 		if ulp {
@@ -227,32 +423,72 @@ func (n *NinjaGenerator) emitNode(node *DepNode) {
 		if err != nil {
 			panic(err)
 		}
-		if depfile != "" {
-			fmt.Fprintf(n.f, " depfile = %s\n", depfile)
-		}
-		// It seems Linux is OK with ~130kB.
-		// TODO: Find this number automatically.
-		ArgLenLimit := 100 * 1000
-		if len(ss) > ArgLenLimit {
-			fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
-			fmt.Fprintf(n.f, " rspfile_content = %s\n", ss)
-			ss = "sh $out.rsp"
+		if n.Sandbox {
+			ss = fmt.Sprintf(`kati-sbox --out-dir $out.sbox --outputs "$out" -- sh -c %s`, shellQuote(ss))
 		}
-		fmt.Fprintf(n.f, " command = %s\n", ss)
+		useRspfile := len(ss) > ArgLenLimit
 
+		ruleKey := strings.Join([]string{ss, depfile, fmt.Sprint(useRspfile), description}, "\x00")
+		cached, ok := n.ruleCache[ruleKey]
+		if ok {
+			ruleName = cached
+		} else {
+			ruleName = n.genRuleName()
+			n.ruleCache[ruleKey] = ruleName
+
+			fmt.Fprintf(n.f, "rule %s\n", ruleName)
+			fmt.Fprintf(n.f, " description = %s\n", description)
+			if depfile != "" {
+				fmt.Fprintf(n.f, " depfile = %s\n", depfile)
+			}
+			if useRspfile {
+				fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
+				fmt.Fprintf(n.f, " rspfile_content = %s\n", ss)
+				ss = "sh $out.rsp"
+			}
+			fmt.Fprintf(n.f, " command = %s\n", ss)
+		}
 	}
 	n.emitBuild(node.Output, ruleName, getDepString(node))
 	if useLocalPool {
 		fmt.Fprintf(n.f, " pool = local_pool\n")
 	}
+	n.recordShortName(node.Output)
+}
 
-	for _, d := range node.Deps {
-		n.emitNode(d)
+// recordShortName remembers output under its leaf basename so
+// emitShortNames can later alias e.g. "out/target/product/foo/bar.img" to
+// "bar.img", matching Android's `m <short>` workflow.
+func (n *NinjaGenerator) recordShortName(output string) {
+	if !n.ShortNames {
+		return
 	}
+	short := filepath.Base(output)
+	n.shortNames[short] = append(n.shortNames[short], output)
 }
 
-func (n *NinjaGenerator) generateShell() {
-	f, err := os.Create("ninja.sh")
+// emitShortNames emits a phony alias for every basename recorded by
+// recordShortName. Both the basenames and the outputs they alias are
+// sorted first so build.ninja is deterministic across runs.
+func (n *NinjaGenerator) emitShortNames() {
+	if !n.ShortNames || len(n.shortNames) == 0 {
+		return
+	}
+	shorts := make([]string, 0, len(n.shortNames))
+	for short := range n.shortNames {
+		shorts = append(shorts, short)
+	}
+	sort.Strings(shorts)
+	fmt.Fprintf(n.f, "\n")
+	for _, short := range shorts {
+		outputs := n.shortNames[short]
+		sort.Strings(outputs)
+		n.emitBuild(short, "phony", " "+strings.Join(outputs, " "))
+	}
+}
+
+func (n *NinjaGenerator) generateShell(targets []string) {
+	f, err := os.Create("ninja" + n.suffix + ".sh")
 	if err != nil {
 		panic(err)
 	}
@@ -271,11 +507,14 @@ func (n *NinjaGenerator) generateShell() {
 			fmt.Fprintf(f, "unset %s\n", name)
 		}
 	}
-	if gomaDir == "" {
-		fmt.Fprintf(f, "exec ninja\n")
-	} else {
-		fmt.Fprintf(f, "exec ninja -j300\n")
+	ninjaCmd := "ninja -f build" + n.suffix + ".ninja"
+	if gomaDir != "" {
+		ninjaCmd += " -j300"
+	}
+	for _, target := range targets {
+		ninjaCmd += " " + shellQuote(target)
 	}
+	fmt.Fprintf(f, "exec %s\n", ninjaCmd)
 
 	err = f.Chmod(0755)
 	if err != nil {
@@ -283,8 +522,12 @@ func (n *NinjaGenerator) generateShell() {
 	}
 }
 
-func (n *NinjaGenerator) generateNinja() {
-	f, err := os.Create("build.ninja")
+// generateNinja writes build<suffix>.ninja. It returns the error built by
+// reportMissing when the graph referenced an output nothing can build;
+// the file is still written in that case; it's the caller's decision
+// whether a missing rule should abort the build.
+func (n *NinjaGenerator) generateNinja() error {
+	f, err := os.Create("build" + n.suffix + ".ninja")
 	if err != nil {
 		panic(err)
 	}
@@ -299,14 +542,71 @@ func (n *NinjaGenerator) generateNinja() {
 		fmt.Fprintf(n.f, " depth = %d\n", runtime.NumCPU())
 	}
 
+	nodes := make([]*DepNode, len(n.nodes))
+	copy(nodes, n.nodes)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Output < nodes[j].Output })
+
 	n.ex = NewExecutor(n.vars)
-	for _, node := range n.nodes {
-		n.emitNode(node)
+	for _, node := range nodes {
+		n.emitNode(node, "")
+	}
+	n.emitShortNames()
+	return n.reportMissing()
+}
+
+// reportMissing returns an error listing every nodeMissing output that
+// another output referenced, with its referrers, so Make's "No rule to make target" style errors aren't
+// silently dropped into a zero exit status; build<suffix>.ninja has
+// already been written at this point regardless, so the caller decides
+// whether this error should abort the build or just be logged. Output is
+// sorted so it's stable across runs.
+func (n *NinjaGenerator) reportMissing() error {
+	if len(n.missingReferrers) == 0 {
+		return nil
 	}
+	var missing []string
+	for output := range n.missingReferrers {
+		missing = append(missing, output)
+	}
+	sort.Strings(missing)
+	var lines []string
+	for _, output := range missing {
+		referrers := n.missingReferrers[output]
+		sort.Strings(referrers)
+		lines = append(lines, fmt.Sprintf("ninja: no rule to make %s, needed by %s", output, strings.Join(referrers, ", ")))
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
+
+// Save generates build<suffix>.ninja and ninja<suffix>.sh for g. targets
+// is the list of user-requested build targets; it is passed through to the
+// generated shell wrapper so `ninja<suffix>.sh` builds exactly what was
+// asked for instead of ninja's default target. The returned error, if
+// any, comes from generateNinja reporting a missing rule; both files are
+// still written.
+func (n *NinjaGenerator) Save(g *DepGraph, suffix string, targets []string) error {
+	n.nodes = g.nodes
+	n.vars = g.vars
+	n.exports = g.exports
+	n.suffix = suffix
+
+	// Each call writes a fresh build<suffix>.ninja, so none of the
+	// per-output bookkeeping from a previous call (against a different
+	// graph) may carry over: a node already seen for another suffix
+	// would be skipped here, and a cached rule name would reference a
+	// `rule` block that was only ever written to the previous suffix's
+	// file.
+	n.ruleId = 0
+	n.state = make(map[string]nodeState)
+	n.missingReferrers = make(map[string][]string)
+	n.ruleCache = make(map[string]string)
+	n.shortNames = make(map[string][]string)
+
+	n.generateShell(targets)
+	return n.generateNinja()
 }
 
-func GenerateNinja(g *DepGraph) {
+func GenerateNinja(g *DepGraph, suffix string, targets []string) error {
 	n := NewNinjaGenerator(g)
-	n.generateShell()
-	n.generateNinja()
+	return n.Save(g, suffix, targets)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestRuleDeduplication verifies that two nodes whose generated commands
+// are identical share a single `rule` block instead of each getting their
+// own ruleN, which is what makes emitNode's rule cache worth having on
+// Android-scale graphs.
+func TestRuleDeduplication(t *testing.T) {
+	a := &DepNode{Output: "a.out", Cmds: []string{"touch stamp"}}
+	b := &DepNode{Output: "b.out", Cmds: []string{"touch stamp"}}
+
+	n := newTestGenerator(t, []*DepNode{a, b})
+	n.emitNode(a, "")
+	n.emitNode(b, "")
+
+	if err := n.f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(n.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(got)
+
+	if count := strings.Count(content, "rule rule"); count != 1 {
+		t.Errorf("got %d rule blocks for two identical commands, want 1:\n%s", count, content)
+	}
+	if !strings.Contains(content, "build a.out: rule0") || !strings.Contains(content, "build b.out: rule0") {
+		t.Errorf("expected both outputs to reference the same cached rule name:\n%s", content)
+	}
+}
+
+// TestRuleNotDeduplicatedWhenCommandsDiffer is the converse: two nodes
+// with different commands must not collapse into one rule.
+func TestRuleNotDeduplicatedWhenCommandsDiffer(t *testing.T) {
+	a := &DepNode{Output: "a.out", Cmds: []string{"touch $@"}}
+	b := &DepNode{Output: "b.out", Cmds: []string{"touch $@.other"}}
+
+	n := newTestGenerator(t, []*DepNode{a, b})
+	n.emitNode(a, "")
+	n.emitNode(b, "")
+
+	if err := n.f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(n.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(got)
+
+	if count := strings.Count(content, "rule rule"); count != 2 {
+		t.Errorf("got %d rule blocks for two different commands, want 2:\n%s", count, content)
+	}
+}
+
+// TestShortNamesAreSortedAliases verifies ShortNames emits one sorted
+// phony alias per output basename, aliasing every full path that shares
+// it, in deterministic (sorted) order.
+func TestShortNamesAreSortedAliases(t *testing.T) {
+	zebra := &DepNode{Output: "out/target/zebra/foo.img", Cmds: []string{"touch $@"}}
+	apple := &DepNode{Output: "out/target/apple/foo.img", Cmds: []string{"touch $@"}}
+	other := &DepNode{Output: "out/target/apple/bar.img", Cmds: []string{"touch $@.other"}}
+
+	n := newTestGenerator(t, []*DepNode{zebra, apple, other})
+	n.ShortNames = true
+	n.emitNode(zebra, "")
+	n.emitNode(apple, "")
+	n.emitNode(other, "")
+	n.emitShortNames()
+
+	if err := n.f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(n.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(got)
+
+	wantFooLine := "build foo.img: phony out/target/apple/foo.img out/target/zebra/foo.img\n"
+	if !strings.Contains(content, wantFooLine) {
+		t.Errorf("output missing sorted alias line %q:\n%s", wantFooLine, content)
+	}
+	wantBarLine := "build bar.img: phony out/target/apple/bar.img\n"
+	if !strings.Contains(content, wantBarLine) {
+		t.Errorf("output missing alias line %q:\n%s", wantBarLine, content)
+	}
+
+	// bar.img (alphabetically first) must appear before foo.img.
+	if strings.Index(content, wantBarLine) > strings.Index(content, wantFooLine) {
+		t.Errorf("short names were not emitted in sorted order:\n%s", content)
+	}
+}
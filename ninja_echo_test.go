@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDetectAndroidEcho(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		wantOK  bool
+		wantOut string
+	}{
+		{
+			name:    "plain echo",
+			cmd:     `echo "Prebuilt: foo"`,
+			wantOK:  true,
+			wantOut: "Prebuilt: foo",
+		},
+		{
+			name:    "make silencer prefix",
+			cmd:     `@echo "Prebuilt: foo"`,
+			wantOK:  true,
+			wantOut: "Prebuilt: foo",
+		},
+		{
+			name:    "leading whitespace",
+			cmd:     `   echo "Prebuilt: foo"`,
+			wantOK:  true,
+			wantOut: "Prebuilt: foo",
+		},
+		{
+			name:   "not an echo",
+			cmd:    `touch $@`,
+			wantOK: false,
+		},
+		{
+			name:   "unquoted argument",
+			cmd:    `echo Prebuilt: foo`,
+			wantOK: false,
+		},
+		{
+			name:   "trailing command after the quote",
+			cmd:    `echo "Prebuilt: foo" && touch $@`,
+			wantOK: false,
+		},
+		{
+			name:   "unterminated quote",
+			cmd:    `echo "Prebuilt: foo`,
+			wantOK: false,
+		},
+		{
+			name:   "command substitution with $(",
+			cmd:    `echo "Prebuilt: $(basename $@)"`,
+			wantOK: false,
+		},
+		{
+			name:   "command substitution with backticks",
+			cmd:    "echo \"Prebuilt: `basename $@`\"",
+			wantOK: false,
+		},
+		{
+			name:    "embedded escaped quote",
+			cmd:     `echo "Prebuilt: \"foo\""`,
+			wantOK:  true,
+			wantOut: `Prebuilt: "foo"`,
+		},
+		{
+			name:    "bare shell variable is allowed through unescaped",
+			cmd:     `echo "Copying $SRC_DIR to out"`,
+			wantOK:  true,
+			wantOut: "Copying $SRC_DIR to out",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := detectAndroidEcho(tt.cmd)
+			if ok != tt.wantOK {
+				t.Fatalf("detectAndroidEcho(%q) ok = %v, want %v", tt.cmd, ok, tt.wantOK)
+			}
+			if ok && got != tt.wantOut {
+				t.Errorf("detectAndroidEcho(%q) = %q, want %q", tt.cmd, got, tt.wantOut)
+			}
+		})
+	}
+}
+
+// TestEmitBuildNodeEscapesEchoDescription is a regression test: a $ in an
+// echoed description must reach build.ninja as $$, exactly like a $ in a
+// command does, or ninja either fails to parse the rule or misreads it as
+// a ninja variable reference.
+func TestEmitBuildNodeEscapesEchoDescription(t *testing.T) {
+	node := &DepNode{
+		Output: "out/foo",
+		Cmds:   []string{`@echo "Copying $$SRC_DIR to out"`, "cp -r $$SRC_DIR out/foo"},
+	}
+	n := newTestGenerator(t, []*DepNode{node})
+	n.DetectAndroidEcho = true
+
+	n.emitBuildNode(node)
+
+	if err := n.f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(n.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLine := " description = Copying $$SRC_DIR to out\n"
+	if !strings.Contains(string(got), wantLine) {
+		t.Errorf("output = %q, want a line %q", got, wantLine)
+	}
+	if strings.Contains(string(got), "description = Copying $SRC_DIR to out\n") {
+		t.Errorf("output contains an unescaped $ in the description: %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestGenerator(t *testing.T, nodes []*DepNode) *NinjaGenerator {
+	t.Helper()
+	n := NewNinjaGenerator(&DepGraph{nodes: nodes, vars: make(Vars), exports: make(map[string]bool)})
+	n.ex = NewExecutor(n.vars)
+	f, err := ioutil.TempFile(t.TempDir(), "ninja_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	n.f = f
+	return n
+}
+
+func TestEmitNodeAliasChain(t *testing.T) {
+	c := &DepNode{Output: "c", Cmds: []string{"touch $@"}}
+	b := &DepNode{Output: "b", Deps: []*DepNode{c}}
+	a := &DepNode{Output: "a", Deps: []*DepNode{b}}
+
+	n := newTestGenerator(t, []*DepNode{a})
+	if st := n.emitNode(a, ""); st != nodeAlias {
+		t.Errorf("state[a] = %v, want nodeAlias", st)
+	}
+	if st := n.state["b"]; st != nodeAlias {
+		t.Errorf("state[b] = %v, want nodeAlias", st)
+	}
+	if st := n.state["c"]; st != nodeBuild {
+		t.Errorf("state[c] = %v, want nodeBuild", st)
+	}
+}
+
+func TestEmitNodeFileOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	if err := os.WriteFile(existing, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &DepNode{Output: existing}
+	n := newTestGenerator(t, []*DepNode{node})
+	if st := n.emitNode(node, "root"); st != nodeFile {
+		t.Errorf("state = %v, want nodeFile", st)
+	}
+	if len(n.missingReferrers) != 0 {
+		t.Errorf("missingReferrers = %v, want none", n.missingReferrers)
+	}
+}
+
+func TestEmitNodeMissing(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "does-not-exist.txt")
+
+	node := &DepNode{Output: missing}
+	n := newTestGenerator(t, []*DepNode{node})
+	if st := n.emitNode(node, "root"); st != nodeMissing {
+		t.Errorf("state = %v, want nodeMissing", st)
+	}
+	if referrers := n.missingReferrers[missing]; len(referrers) != 1 || referrers[0] != "root" {
+		t.Errorf("missingReferrers[%s] = %v, want [root]", missing, referrers)
+	}
+}
+
+// TestReportMissingReturnsError verifies a nodeMissing output surfaces as
+// an error the caller can act on, not just a stderr line that's easy to
+// lose in build noise.
+func TestReportMissingReturnsError(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "does-not-exist.txt")
+
+	node := &DepNode{Output: missing}
+	n := newTestGenerator(t, []*DepNode{node})
+	n.emitNode(node, "root")
+
+	err := n.reportMissing()
+	if err == nil {
+		t.Fatal("reportMissing() = nil, want an error for a missing output")
+	}
+	if !strings.Contains(err.Error(), missing) || !strings.Contains(err.Error(), "root") {
+		t.Errorf("reportMissing() error = %q, want it to mention %q and %q", err, missing, "root")
+	}
+}
+
+// TestReportMissingNilWhenNothingMissing verifies a graph with no
+// nodeMissing outputs reports no error.
+func TestReportMissingNilWhenNothingMissing(t *testing.T) {
+	node := &DepNode{Output: "out", Cmds: []string{"touch $@"}}
+	n := newTestGenerator(t, []*DepNode{node})
+	n.emitNode(node, "")
+
+	if err := n.reportMissing(); err != nil {
+		t.Errorf("reportMissing() = %v, want nil", err)
+	}
+}
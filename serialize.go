@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"time"
+)
+
+// katiCacheVersion guards the serialized format itself; bump it whenever
+// savedGraph's shape changes so an old cache is rejected instead of
+// decoded into the wrong fields.
+const katiCacheVersion = "2"
+
+// savedMakefile records the path and mtime of a Makefile that was read
+// while building the DepGraph, so Load can tell whether any of them
+// changed since the graph was cached.
+type savedMakefile struct {
+	Path    string
+	ModTime time.Time
+}
+
+// savedNode is a DepNode flattened for serialization: Output and Cmds are
+// stored as indices into the enclosing savedGraph.Strings table, and Deps
+// are indices into savedGraph.Nodes, so neither a repeated string nor a
+// node shared by several parents is ever written out twice.
+type savedNode struct {
+	Output      int
+	Cmds        []int
+	Deps        []int
+	IsPhony     bool
+	IsOrderOnly bool
+}
+
+// savedGraph is the on-disk representation written by DepGraph.Save and
+// read back by Load.
+type savedGraph struct {
+	KatiCacheVersion string
+	FlagDigest       string
+	Makefiles        []savedMakefile
+	Strings          []string
+	Nodes            []savedNode
+	Roots            []int
+	Vpaths           []string
+	Vars             Vars
+	Exports          map[string]bool
+}
+
+// stringInterner assigns each distinct string a stable index the first
+// time it's seen, so Save can write node Output/Cmds text once no matter
+// how many nodes repeat it.
+type stringInterner struct {
+	ids   map[string]int
+	table []string
+}
+
+func newStringInterner() *stringInterner {
+	return &stringInterner{ids: make(map[string]int)}
+}
+
+func (in *stringInterner) intern(s string) int {
+	if id, ok := in.ids[s]; ok {
+		return id
+	}
+	id := len(in.table)
+	in.ids[s] = id
+	in.table = append(in.table, s)
+	return id
+}
+
+func (in *stringInterner) internAll(ss []string) []int {
+	ids := make([]int, len(ss))
+	for i, s := range ss {
+		ids[i] = in.intern(s)
+	}
+	return ids
+}
+
+// Save writes g to path so a later Load can skip re-parsing every
+// Makefile. makefiles is the set of Makefile paths that were read to
+// build g; their current mtimes are recorded so Load can detect when the
+// cache is stale. flagDigest identifies the kati flags g was built with,
+// so a cache built under a different invocation is never reused.
+func (g *DepGraph) Save(path string, makefiles []string, flagDigest string) error {
+	strs := newStringInterner()
+
+	ids := make(map[*DepNode]int)
+	var nodes []savedNode
+	var walk func(node *DepNode) int
+	walk = func(node *DepNode) int {
+		if id, ok := ids[node]; ok {
+			return id
+		}
+		id := len(nodes)
+		ids[node] = id
+		nodes = append(nodes, savedNode{})
+		deps := make([]int, len(node.Deps))
+		for i, d := range node.Deps {
+			deps[i] = walk(d)
+		}
+		nodes[id] = savedNode{
+			Output:      strs.intern(node.Output),
+			Cmds:        strs.internAll(node.Cmds),
+			Deps:        deps,
+			IsPhony:     node.IsPhony,
+			IsOrderOnly: node.IsOrderOnly,
+		}
+		return id
+	}
+
+	roots := make([]int, len(g.nodes))
+	for i, node := range g.nodes {
+		roots[i] = walk(node)
+	}
+
+	mfs := make([]savedMakefile, 0, len(makefiles))
+	for _, path := range makefiles {
+		st, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("kati: cannot stat %s for the graph cache: %v", path, err)
+		}
+		mfs = append(mfs, savedMakefile{Path: path, ModTime: st.ModTime()})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&savedGraph{
+		KatiCacheVersion: katiCacheVersion,
+		FlagDigest:       flagDigest,
+		Makefiles:        mfs,
+		Strings:          strs.table,
+		Nodes:            nodes,
+		Roots:            roots,
+		Vpaths:           g.vpaths,
+		Vars:             g.vars,
+		Exports:          g.exports,
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Load reads a DepGraph previously written by Save from path. It returns
+// an error if the cache's flagDigest doesn't match the caller's, or if
+// any Makefile recorded in it has changed since, so the caller knows to
+// fall back to a full re-parse rather than build from a stale graph.
+func Load(path string, flagDigest string) (*DepGraph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sg savedGraph
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&sg); err != nil {
+		return nil, err
+	}
+	if sg.KatiCacheVersion != katiCacheVersion {
+		return nil, fmt.Errorf("kati: graph cache %s is from an incompatible kati version", path)
+	}
+	if sg.FlagDigest != flagDigest {
+		return nil, fmt.Errorf("kati: graph cache %s was written with different flags", path)
+	}
+	for _, mf := range sg.Makefiles {
+		st, err := os.Stat(mf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("kati: %s referenced by graph cache %s is gone: %v", mf.Path, path, err)
+		}
+		if !st.ModTime().Equal(mf.ModTime) {
+			return nil, fmt.Errorf("kati: %s changed since graph cache %s was written", mf.Path, path)
+		}
+	}
+
+	str := func(id int) string { return sg.Strings[id] }
+	strAll := func(ids []int) []string {
+		ss := make([]string, len(ids))
+		for i, id := range ids {
+			ss[i] = str(id)
+		}
+		return ss
+	}
+
+	nodes := make([]*DepNode, len(sg.Nodes))
+	for i, sn := range sg.Nodes {
+		nodes[i] = &DepNode{
+			Output:      str(sn.Output),
+			Cmds:        strAll(sn.Cmds),
+			IsPhony:     sn.IsPhony,
+			IsOrderOnly: sn.IsOrderOnly,
+		}
+	}
+	for i, sn := range sg.Nodes {
+		deps := make([]*DepNode, len(sn.Deps))
+		for j, depID := range sn.Deps {
+			deps[j] = nodes[depID]
+		}
+		nodes[i].Deps = deps
+	}
+
+	roots := make([]*DepNode, len(sg.Roots))
+	for i, id := range sg.Roots {
+		roots[i] = nodes[id]
+	}
+
+	return &DepGraph{
+		nodes:   roots,
+		vars:    sg.Vars,
+		exports: sg.Exports,
+		vpaths:  sg.Vpaths,
+	}, nil
+}
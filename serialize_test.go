@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func buildTestGraph() *DepGraph {
+	shared := &DepNode{Output: "shared.o", Cmds: []string{"cc -c shared.c"}}
+	a := &DepNode{Output: "a.out", Deps: []*DepNode{shared}}
+	b := &DepNode{Output: "b.out", Deps: []*DepNode{shared}}
+	return &DepGraph{
+		nodes:   []*DepNode{a, b},
+		vars:    Vars{"CC": "cc"},
+		exports: map[string]bool{"PATH": true},
+		vpaths:  []string{"vendor", "external"},
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	mk := filepath.Join(dir, "Android.mk")
+	if err := os.WriteFile(mk, []byte("all:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "graph.cache")
+
+	g := buildTestGraph()
+	if err := g.Save(cachePath, []string{mk}, "digest-1"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := Load(cachePath, "digest-1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if len(loaded.nodes) != 2 {
+		t.Fatalf("len(nodes) = %d, want 2", len(loaded.nodes))
+	}
+	if loaded.nodes[0].Output != "a.out" || loaded.nodes[1].Output != "b.out" {
+		t.Errorf("unexpected root outputs: %s, %s", loaded.nodes[0].Output, loaded.nodes[1].Output)
+	}
+	if loaded.nodes[0].Deps[0] != loaded.nodes[1].Deps[0] {
+		t.Errorf("shared dep was not deduplicated across roots")
+	}
+	if got := loaded.nodes[0].Deps[0].Cmds[0]; got != "cc -c shared.c" {
+		t.Errorf("shared dep Cmds = %q, want %q", got, "cc -c shared.c")
+	}
+	if loaded.vars["CC"] != "cc" {
+		t.Errorf("vars[CC] = %q, want cc", loaded.vars["CC"])
+	}
+	if !loaded.exports["PATH"] {
+		t.Errorf("exports[PATH] = false, want true")
+	}
+	if got := loaded.vpaths; len(got) != 2 || got[0] != "vendor" || got[1] != "external" {
+		t.Errorf("vpaths = %v, want [vendor external]", got)
+	}
+}
+
+// TestSaveInternsRepeatedStrings verifies that a Cmds string repeated
+// across many nodes is written to the cache once, not once per node.
+func TestSaveInternsRepeatedStrings(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "graph.cache")
+
+	const recipe = "touch $@"
+	var nodes []*DepNode
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &DepNode{Output: fmt.Sprintf("out%d", i), Cmds: []string{recipe}})
+	}
+	g := &DepGraph{nodes: nodes, vars: make(Vars), exports: make(map[string]bool)}
+	if err := g.Save(cachePath, nil, "digest-1"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	f, err := os.Open(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var sg savedGraph
+	if err := gob.NewDecoder(f).Decode(&sg); err != nil {
+		t.Fatal(err)
+	}
+
+	occurrences := 0
+	for _, s := range sg.Strings {
+		if s == recipe {
+			occurrences++
+		}
+	}
+	if occurrences != 1 {
+		t.Errorf("recipe %q appears %d times in the string table, want 1", recipe, occurrences)
+	}
+
+	loaded, err := Load(cachePath, "digest-1")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for i, node := range loaded.nodes {
+		if node.Cmds[0] != recipe {
+			t.Errorf("nodes[%d].Cmds[0] = %q, want %q", i, node.Cmds[0], recipe)
+		}
+	}
+}
+
+func TestLoadRejectsDifferentFlagDigest(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "graph.cache")
+
+	g := buildTestGraph()
+	if err := g.Save(cachePath, nil, "digest-1"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := Load(cachePath, "digest-2"); err == nil {
+		t.Fatal("Load: expected an error for a mismatched flag digest, got nil")
+	}
+}
+
+func TestLoadRejectsStaleMakefile(t *testing.T) {
+	dir := t.TempDir()
+	mk := filepath.Join(dir, "Android.mk")
+	if err := os.WriteFile(mk, []byte("all:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "graph.cache")
+
+	g := buildTestGraph()
+	if err := g.Save(cachePath, []string{mk}, "digest-1"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(mk, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(cachePath, "digest-1"); err == nil {
+		t.Fatal("Load: expected an error for a changed Makefile, got nil")
+	}
+}